@@ -0,0 +1,128 @@
+// Package engine defines the boundary between canoe's Node and whichever
+// consensus library actually drives leader election and log replication.
+// canoe has historically been hard-bound to github.com/coreos/etcd/raft;
+// ConsensusEngine lets a second backend (see engine/hashiraft) sit behind
+// the same Node/FSM contract applications already depend on.
+//
+// Status: this seam is not yet consumed anywhere. Node (see canoe.Node)
+// still calls directly into github.com/coreos/etcd/raft rather than
+// through ConsensusEngine, so engine/etcdraft and engine/hashiraft have no
+// caller today; NodeConfig.Engine rejects any value other than the
+// etcd-raft default rather than pretending otherwise. Wiring Node's
+// Start/scanReady/FSM-apply path against ConsensusEngine is what would
+// make a non-default engine selectable.
+package engine
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// Ready carries everything a caller needs to persist and apply after a
+// round of the consensus engine's internal event loop, mirroring what
+// etcd/raft.Ready exposes today so Node's scanReady loop can stay largely
+// unchanged regardless of which engine is selected.
+type Ready struct {
+	// CommittedEntries are log entries, in order, that have been committed
+	// and are now safe to hand to the FSM.
+	CommittedEntries []LogEntry
+
+	// SoftState reports leadership changes. Nil when nothing changed.
+	SoftState *SoftState
+
+	// ReadIndexResults answers outstanding ReadIndex calls that have been
+	// satisfied since the last Ready.
+	ReadIndexResults []ReadIndexResult
+
+	// SnapshotAvailable is set when the engine wants Node to apply a new
+	// snapshot before continuing, e.g. because a follower fell too far
+	// behind for log replication to catch it up.
+	SnapshotAvailable bool
+}
+
+// LogEntry is a single committed entry, either a normal proposal or a
+// membership change.
+type LogEntry struct {
+	Index        uint64
+	IsConfChange bool
+	Data         []byte
+}
+
+// SoftState reports the engine's current notion of cluster leadership.
+type SoftState struct {
+	Lead     uint64
+	IsLeader bool
+}
+
+// ReadIndexResult correlates a caller-supplied token (see ConsensusEngine.ReadIndex)
+// with the log index that must be applied before the read it guards is
+// linearizable.
+type ReadIndexResult struct {
+	RequestCtx []byte
+	Index      uint64
+}
+
+// MemberChange describes an addition, removal, learner promotion, or
+// demotion of a cluster member.
+type MemberChange struct {
+	NodeID    uint64
+	Context   []byte
+	IsRemove  bool
+	IsLearner bool
+}
+
+// ConsensusEngine is the seam through which canoe's Node could talk to a
+// consensus library instead of calling directly into
+// github.com/coreos/etcd/raft; Node does not use it yet (see the package
+// doc). Any backend that can reach agreement on a sequence of opaque log
+// entries can implement it.
+type ConsensusEngine interface {
+	// Propose submits data to be replicated. What happens once it is
+	// committed depends on the engine: engine/etcdraft hands it back as a
+	// LogEntry in a future Ready, while engine/hashiraft applies it to the
+	// FSM itself and never reports it in Ready.CommittedEntries.
+	Propose(ctx context.Context, data []byte) error
+
+	// ProposeConfChange submits a membership change.
+	ProposeConfChange(ctx context.Context, change MemberChange) error
+
+	// ReadIndex asks the engine for the log index that must be applied
+	// locally before a linearizable read tagged with requestCtx is safe.
+	// The answer arrives asynchronously via Ready.ReadIndexResults.
+	ReadIndex(ctx context.Context, requestCtx []byte) error
+
+	// Tick advances the engine's internal logical clock by one unit.
+	Tick()
+
+	// Ready returns a channel the caller should select on to drive the
+	// engine's event loop, analogous to etcd/raft.Node.Ready().
+	Ready() <-chan Ready
+
+	// Advance signals the engine that the most recent Ready has been fully
+	// processed and it's safe to produce the next one.
+	Advance()
+
+	// TransferLeadership asks the engine to hand leadership to transferee.
+	TransferLeadership(ctx context.Context, transferee uint64) error
+
+	// Status reports the engine's believed leader and applied index.
+	Status() Status
+
+	// SnapshotTo and RestoreFrom persist and load the engine's own
+	// replicated log/state (not the application FSM's), so a restarted
+	// node can rejoin without replaying its entire history.
+	SnapshotTo(w io.Writer) error
+	RestoreFrom(r io.Reader) error
+
+	// Stop releases any resources the engine is holding (goroutines,
+	// open files, file descriptors for its log store, etc).
+	Stop()
+}
+
+// Status is a read-only snapshot of the engine's view of the cluster.
+type Status struct {
+	ID      uint64
+	Leader  uint64
+	Applied uint64
+}
@@ -0,0 +1,170 @@
+// Package etcdraft implements engine.ConsensusEngine on top of
+// github.com/coreos/etcd/raft, which is what canoe's Node has always used
+// directly. It exists so Node can eventually be rewritten against
+// engine.ConsensusEngine without changing behavior for existing
+// applications: this is the default engine.
+package etcdraft
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+
+	"github.com/AdoHe/canoe/engine"
+)
+
+// Config mirrors the subset of raft.Config canoe's Node already sets up
+// itself; it's kept separate from raft.Config so callers of this package
+// don't need to import etcd/raft directly.
+type Config struct {
+	ID              uint64
+	ElectionTick    int
+	HeartbeatTick   int
+	MaxSizePerMsg   uint64
+	MaxInflightMsgs int
+	CheckQuorum     bool
+	PreVote         bool
+	Peers           []raft.Peer
+	Restart         bool
+	Logger          raft.Logger
+}
+
+// Engine adapts raft.Node to engine.ConsensusEngine.
+type Engine struct {
+	node    raft.Node
+	storage *raft.MemoryStorage
+}
+
+// New starts (or restarts) an etcd/raft node and wraps it as a
+// ConsensusEngine.
+func New(cfg *Config, storage *raft.MemoryStorage) *Engine {
+	raftCfg := &raft.Config{
+		ID:              cfg.ID,
+		ElectionTick:    cfg.ElectionTick,
+		HeartbeatTick:   cfg.HeartbeatTick,
+		Storage:         storage,
+		MaxSizePerMsg:   cfg.MaxSizePerMsg,
+		MaxInflightMsgs: cfg.MaxInflightMsgs,
+		CheckQuorum:     cfg.CheckQuorum,
+		PreVote:         cfg.PreVote,
+		Logger:          cfg.Logger,
+	}
+
+	var node raft.Node
+	if cfg.Restart {
+		node = raft.RestartNode(raftCfg)
+	} else {
+		node = raft.StartNode(raftCfg, cfg.Peers)
+	}
+
+	return &Engine{node: node, storage: storage}
+}
+
+func (e *Engine) Propose(ctx context.Context, data []byte) error {
+	return e.node.Propose(ctx, data)
+}
+
+func (e *Engine) ProposeConfChange(ctx context.Context, change engine.MemberChange) error {
+	cc := raftpb.ConfChange{
+		NodeID:  change.NodeID,
+		Context: change.Context,
+	}
+
+	switch {
+	case change.IsRemove:
+		cc.Type = raftpb.ConfChangeRemoveNode
+	case change.IsLearner:
+		cc.Type = raftpb.ConfChangeAddLearnerNode
+	default:
+		cc.Type = raftpb.ConfChangeAddNode
+	}
+
+	return e.node.ProposeConfChange(ctx, cc)
+}
+
+func (e *Engine) ReadIndex(ctx context.Context, requestCtx []byte) error {
+	return e.node.ReadIndex(ctx, requestCtx)
+}
+
+func (e *Engine) Tick() {
+	e.node.Tick()
+}
+
+func (e *Engine) Ready() <-chan engine.Ready {
+	out := make(chan engine.Ready)
+	go func() {
+		for rd := range e.node.Ready() {
+			out <- translateReady(rd)
+		}
+		close(out)
+	}()
+	return out
+}
+
+func (e *Engine) Advance() {
+	e.node.Advance()
+}
+
+func (e *Engine) TransferLeadership(ctx context.Context, transferee uint64) error {
+	e.node.TransferLeadership(ctx, e.status().ID, transferee)
+	return nil
+}
+
+func (e *Engine) Status() engine.Status {
+	return e.status()
+}
+
+func (e *Engine) status() engine.Status {
+	st := e.node.Status()
+	return engine.Status{
+		ID:      st.ID,
+		Leader:  st.Lead,
+		Applied: st.Applied,
+	}
+}
+
+// SnapshotTo and RestoreFrom are no-ops for this engine: canoe's Node
+// already persists the etcd/raft WAL and snapshot files itself, so there's
+// no separate engine-level state to stream here.
+func (e *Engine) SnapshotTo(w io.Writer) error  { return nil }
+func (e *Engine) RestoreFrom(r io.Reader) error { return nil }
+
+func (e *Engine) Stop() {
+	e.node.Stop()
+}
+
+func translateReady(rd raft.Ready) engine.Ready {
+	out := engine.Ready{}
+
+	for _, ent := range rd.CommittedEntries {
+		if len(ent.Data) == 0 {
+			continue
+		}
+		out.CommittedEntries = append(out.CommittedEntries, engine.LogEntry{
+			Index:        ent.Index,
+			IsConfChange: ent.Type == raftpb.EntryConfChange,
+			Data:         ent.Data,
+		})
+	}
+
+	if rd.SoftState != nil {
+		out.SoftState = &engine.SoftState{
+			Lead:     rd.SoftState.Lead,
+			IsLeader: rd.SoftState.RaftState == raft.StateLeader,
+		}
+	}
+
+	for _, rs := range rd.ReadStates {
+		out.ReadIndexResults = append(out.ReadIndexResults, engine.ReadIndexResult{
+			RequestCtx: rs.RequestCtx,
+			Index:      rs.Index,
+		})
+	}
+
+	out.SnapshotAvailable = !raft.IsEmptySnap(rd.Snapshot)
+
+	return out
+}
@@ -0,0 +1,327 @@
+// Package hashiraft implements engine.ConsensusEngine on top of
+// hashicorp/raft, backed by a BoltDB log store and a file-based snapshot
+// store. The intent is to let operators move off the unmaintained etcd v2
+// raft imports (see engine/etcdraft) onto a more actively maintained
+// consensus library without rewriting their FSM, once canoe.Node is wired
+// against engine.ConsensusEngine (it isn't yet - see the package doc on
+// engine and the TODO on NodeConfig.Engine).
+package hashiraft
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	hraft "github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+
+	"github.com/AdoHe/canoe"
+	"github.com/AdoHe/canoe/engine"
+)
+
+// Config is the subset of hashicorp/raft setup canoe's Node needs to
+// supply. BoltPath and SnapshotDir are both required; hashicorp/raft
+// doesn't support the in-memory-only mode canoe's etcd engine allows.
+type Config struct {
+	ID          uint64
+	BindAddr    string
+	BoltPath    string
+	SnapshotDir string
+	Bootstrap   bool
+	FSM         canoe.FSM
+}
+
+// Engine adapts a *hraft.Raft to engine.ConsensusEngine.
+type Engine struct {
+	raft     *hraft.Raft
+	logStore *raftboltdb.BoltStore
+	readyC   chan engine.Ready
+	stopc    chan struct{}
+
+	// observeLeaderChanges and ReadIndex both produce Ready values; emitMu
+	// and emitQueue fan them into a single drainEmits goroutine so there's
+	// only ever one sender on readyC. Without this, two producers racing to
+	// fill readyC's buffer could block each other indefinitely.
+	emitMu    sync.Mutex
+	emitQueue []engine.Ready
+	emitWake  chan struct{}
+}
+
+// New opens (or creates) the bolt log store and file snapshot store at the
+// configured paths and starts a hashicorp/raft node over them.
+func New(cfg *Config) (*Engine, error) {
+	logStore, err := raftboltdb.NewBoltStore(cfg.BoltPath)
+	if err != nil {
+		return nil, err
+	}
+
+	snapStore, err := hraft.NewFileSnapshotStore(cfg.SnapshotDir, 3, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := hraft.NewTCPTransport(cfg.BindAddr, nil, 3, 10*time.Second, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+
+	raftCfg := hraft.DefaultConfig()
+	raftCfg.LocalID = serverID(cfg.ID)
+
+	r, err := hraft.NewRaft(raftCfg, &fsmAdapter{fsm: cfg.FSM}, logStore, logStore, snapStore, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Bootstrap {
+		r.BootstrapCluster(hraft.Configuration{
+			Servers: []hraft.Server{
+				{ID: raftCfg.LocalID, Address: transport.LocalAddr()},
+			},
+		})
+	}
+
+	e := &Engine{
+		raft:     r,
+		logStore: logStore,
+		readyC:   make(chan engine.Ready, 1),
+		stopc:    make(chan struct{}),
+		emitWake: make(chan struct{}, 1),
+	}
+
+	go e.observeLeaderChanges()
+	go e.drainEmits()
+
+	return e, nil
+}
+
+// serverID renders a canoe node ID in the string form hashicorp/raft's
+// ServerID expects.
+func serverID(id uint64) hraft.ServerID {
+	return hraft.ServerID(strconv.FormatUint(id, 10))
+}
+
+// observeLeaderChanges feeds hraft's leader-change notifications into our
+// Ready channel so Node's scanReady loop sees soft-state transitions the
+// same way it would from the etcd engine.
+func (e *Engine) observeLeaderChanges() {
+	for {
+		select {
+		case isLeader := <-e.raft.LeaderCh():
+			e.emit(engine.Ready{
+				SoftState: &engine.SoftState{
+					IsLeader: isLeader,
+				},
+			})
+		case <-e.stopc:
+			return
+		}
+	}
+}
+
+// emit queues rd for delivery on readyC and wakes drainEmits if it's idle.
+// Queuing (rather than sending on readyC directly) lets observeLeaderChanges
+// and ReadIndex both produce without either blocking the other.
+func (e *Engine) emit(rd engine.Ready) {
+	e.emitMu.Lock()
+	e.emitQueue = append(e.emitQueue, rd)
+	e.emitMu.Unlock()
+
+	select {
+	case e.emitWake <- struct{}{}:
+	default:
+	}
+}
+
+// drainEmits is the sole sender on readyC, so producers calling emit never
+// contend with each other for the send.
+func (e *Engine) drainEmits() {
+	for {
+		e.emitMu.Lock()
+		var rd engine.Ready
+		has := len(e.emitQueue) > 0
+		if has {
+			rd = e.emitQueue[0]
+			e.emitQueue = e.emitQueue[1:]
+		}
+		e.emitMu.Unlock()
+
+		if !has {
+			select {
+			case <-e.emitWake:
+			case <-e.stopc:
+				return
+			}
+			continue
+		}
+
+		select {
+		case e.readyC <- rd:
+		case <-e.stopc:
+			return
+		}
+	}
+}
+
+// Propose applies data and waits for either the result or ctx to be done.
+// hashicorp/raft's ApplyFuture has no way to cancel the underlying apply
+// once started, so a canceled ctx stops us from waiting on it but doesn't
+// stop the apply itself from eventually completing in the background.
+func (e *Engine) Propose(ctx context.Context, data []byte) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- e.raft.Apply(data, 0).Error()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ProposeConfChange translates a canoe membership change into the nearest
+// hashicorp/raft equivalent: AddVoter for a normal add or promotion,
+// AddNonvoter for a learner, and RemoveServer for a removal.
+func (e *Engine) ProposeConfChange(ctx context.Context, change engine.MemberChange) error {
+	id := serverID(change.NodeID)
+
+	if change.IsRemove {
+		return e.raft.RemoveServer(id, 0, 0).Error()
+	}
+
+	addr := hraft.ServerAddress(change.Context)
+	if change.IsLearner {
+		return e.raft.AddNonvoter(id, addr, 0, 0).Error()
+	}
+	return e.raft.AddVoter(id, addr, 0, 0).Error()
+}
+
+// ReadIndex has no direct hashicorp/raft analog; VerifyLeader is the
+// closest equivalent (it round-trips a heartbeat to a quorum of followers
+// before returning), so we use it and report the current applied index as
+// the index that's already safe to read at.
+func (e *Engine) ReadIndex(ctx context.Context, requestCtx []byte) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- e.raft.VerifyLeader().Error()
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.emit(engine.Ready{
+		ReadIndexResults: []engine.ReadIndexResult{
+			{RequestCtx: requestCtx, Index: e.raft.AppliedIndex()},
+		},
+	})
+	return nil
+}
+
+// Tick is a no-op: hashicorp/raft drives its own internal timers and has
+// no equivalent of etcd/raft's externally-ticked logical clock.
+func (e *Engine) Tick() {}
+
+func (e *Engine) Ready() <-chan engine.Ready {
+	return e.readyC
+}
+
+// Advance is a no-op: hashicorp/raft applies committed entries internally
+// as soon as they're committed, with no caller-paced Ready/Advance cycle.
+func (e *Engine) Advance() {}
+
+// TransferLeadership looks transferee's address up in the current cluster
+// configuration and asks hashicorp/raft to hand leadership to it.
+func (e *Engine) TransferLeadership(ctx context.Context, transferee uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cfgFuture := e.raft.GetConfiguration()
+	if err := cfgFuture.Error(); err != nil {
+		return err
+	}
+
+	id := serverID(transferee)
+	for _, srv := range cfgFuture.Configuration().Servers {
+		if srv.ID == id {
+			return e.raft.LeadershipTransferToServer(id, srv.Address).Error()
+		}
+	}
+	return errors.New("hashiraft: transferee is not in the cluster configuration")
+}
+
+func (e *Engine) Status() engine.Status {
+	_, leaderID := e.raft.LeaderWithID()
+	leader, _ := strconv.ParseUint(string(leaderID), 10, 64)
+	return engine.Status{
+		Leader:  leader,
+		Applied: e.raft.AppliedIndex(),
+	}
+}
+
+// SnapshotTo and RestoreFrom are no-ops: hashicorp/raft already owns its
+// log store and snapshot store lifecycle on disk.
+func (e *Engine) SnapshotTo(w io.Writer) error  { return nil }
+func (e *Engine) RestoreFrom(r io.Reader) error { return nil }
+
+func (e *Engine) Stop() {
+	close(e.stopc)
+	e.raft.Shutdown()
+	e.logStore.Close()
+}
+
+// fsmAdapter lets a canoe.FSM satisfy hashicorp/raft's own FSM interface,
+// which is shaped differently (Apply returns an interface{} result, and
+// Snapshot/Restore stream through io.ReadCloser/raft.SnapshotSink rather
+// than canoe's in-memory SnapshotData).
+type fsmAdapter struct {
+	fsm canoe.FSM
+}
+
+func (a *fsmAdapter) Apply(log *hraft.Log) interface{} {
+	return a.fsm.Apply(canoe.LogData(log.Data))
+}
+
+func (a *fsmAdapter) Snapshot() (hraft.FSMSnapshot, error) {
+	data, err := a.fsm.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{data: []byte(data)}, nil
+}
+
+func (a *fsmAdapter) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return a.fsm.Restore(canoe.SnapshotData(data))
+}
+
+type fsmSnapshot struct {
+	data []byte
+}
+
+func (s *fsmSnapshot) Persist(sink hraft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
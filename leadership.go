@@ -0,0 +1,43 @@
+package canoe
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/raft"
+)
+
+var errNodeStoppedDuringTransfer = errors.New("canoe: node stopped while waiting for leadership transfer")
+
+// TransferLeadership asks raft to hand leadership to transferee and blocks
+// until a SoftState update confirms transferee is the new leader, or ctx is
+// done. It's meant for graceful rolling restarts: step down cleanly before
+// taking a leader out of the cluster instead of waiting on an election
+// timeout to pick a new one. HandleLeaderTransfer exposes this over HTTP
+// for callers that would rather drive it from outside the process.
+func (rn *Node) TransferLeadership(ctx context.Context, transferee uint64) error {
+	observChan := make(chan Observation)
+	filterFn := func(o Observation) bool {
+		ss, ok := o.(raft.SoftState)
+		if !ok {
+			return false
+		}
+		return ss.Lead == transferee
+	}
+
+	observer := NewObserver(observChan, filterFn)
+	rn.RegisterObserver(observer)
+	defer rn.UnregisterObserver(observer)
+
+	rn.node.TransferLeadership(ctx, rn.id, transferee)
+
+	select {
+	case <-observChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rn.stopc:
+		return errNodeStoppedDuringTransfer
+	}
+}
@@ -0,0 +1,60 @@
+package canoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// leaderTransferRequest is the POST body HandleLeaderTransfer expects: the
+// node ID leadership should move to.
+type leaderTransferRequest struct {
+	Transferee uint64 `json:"transferee"`
+}
+
+// leaderStatusResponse is what a GET to HandleLeaderTransfer reports.
+type leaderStatusResponse struct {
+	Leader uint64 `json:"leader"`
+}
+
+// HandleLeaderTransfer is the HTTP side of TransferLeadership: GET reports
+// the node this one currently believes is leader, POST asks this node to
+// hand leadership to the transferee named in the body and blocks until
+// TransferLeadership confirms it (or the request is canceled). It exists
+// so the rolling-restart use case TransferLeadership's own doc comment
+// describes can be driven from outside the process, instead of requiring
+// whatever is restarting the node to link against canoe just to call it.
+//
+// serveHTTP's config service isn't in this file, so wiring this in is a
+// single mux.HandleFunc("/leader/transfer", rn.HandleLeaderTransfer) away.
+func (rn *Node) HandleLeaderTransfer(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rn.handleLeaderStatus(w, r)
+	case http.MethodPost:
+		rn.handleLeaderTransferRequest(w, r)
+	default:
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodPost))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (rn *Node) handleLeaderStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leaderStatusResponse{Leader: rn.node.Status().Lead})
+}
+
+func (rn *Node) handleLeaderTransferRequest(w http.ResponseWriter, r *http.Request) {
+	var req leaderTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("canoe: malformed leader transfer request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if err := rn.TransferLeadership(r.Context(), req.Transferee); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
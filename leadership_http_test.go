@@ -0,0 +1,34 @@
+package canoe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleLeaderTransferRejectsOtherMethods(t *testing.T) {
+	rn := &Node{}
+
+	req := httptest.NewRequest(http.MethodDelete, "/leader/transfer", nil)
+	rec := httptest.NewRecorder()
+
+	rn.HandleLeaderTransfer(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleLeaderTransferRejectsMalformedBody(t *testing.T) {
+	rn := &Node{}
+
+	req := httptest.NewRequest(http.MethodPost, "/leader/transfer", strings.NewReader("not json"))
+	rec := httptest.NewRecorder()
+
+	rn.HandleLeaderTransfer(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
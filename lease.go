@@ -0,0 +1,377 @@
+package canoe
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// LeaseID identifies a lease granted by GrantLease. It's minted from the
+// same requestIDGenerator used for read/propose correlation, so it's unique
+// across the cluster without a dedicated ID scheme.
+type LeaseID uint64
+
+// LeaseExpirer is an optional extension to FSM. If an FSM implements it,
+// Node calls OnLeaseExpire whenever a lease it granted reaches the end of
+// its TTL, so the FSM can evict whatever it associated with that lease.
+// FSMs that don't need TTL-backed state can ignore leases entirely.
+type LeaseExpirer interface {
+	OnLeaseExpire(id LeaseID)
+}
+
+// leaseOp distinguishes the handful of ways a lease entry can change the
+// replicated lease table.
+type leaseOp byte
+
+const (
+	leaseOpGrant leaseOp = iota + 1
+	leaseOpKeepAlive
+	leaseOpRevoke
+	leaseOpExpire
+)
+
+// leaseEntryMagic tags entries that carry a lease operation so publishEntries
+// can route them to applyLeaseEntry instead of the FSM, the same way
+// proposalEnvelopeMagic tags Propose-with-response entries. It must not
+// collide with proposalEnvelopeMagic; both are checked against entry.Data[0].
+const leaseEntryMagic byte = 0x7E
+
+type leaseEntry struct {
+	Op  leaseOp       `json:"op"`
+	ID  LeaseID       `json:"id"`
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+func encodeLeaseEntry(e *leaseEntry) ([]byte, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{leaseEntryMagic}, body...), nil
+}
+
+func decodeLeaseEntry(data []byte) (*leaseEntry, bool) {
+	if len(data) == 0 || data[0] != leaseEntryMagic {
+		return nil, false
+	}
+
+	var e leaseEntry
+	if err := json.Unmarshal(data[1:], &e); err != nil {
+		return nil, false
+	}
+	return &e, true
+}
+
+// leaseRecord is the in-memory, per-node view of a lease: every replica
+// keeps one of these for each active lease so it can answer OnLeaseExpire
+// consistently, but only the leader's copy feeds leaseQueue.
+type leaseRecord struct {
+	ID        LeaseID
+	TTL       time.Duration
+	ExpiresAt time.Time
+}
+
+// leaseSnapshot is the form a leaseRecord takes inside snapshotMetadata.
+// RemainingNanos is relative to the snapshot's own wall-clock time rather
+// than an absolute deadline; see the doc comment on snapshotMetadata.Leases.
+type leaseSnapshot struct {
+	TTL            time.Duration `json:"ttl"`
+	RemainingNanos int64         `json:"remaining_nanos"`
+}
+
+// leaseQueueItem is a single (expiresAt, id) pair in the leader's expiry
+// heap. Renewing a lease pushes a new item rather than mutating the one
+// already queued; fireExpiredLeases discards any popped item whose
+// expiresAt no longer matches the live leaseRecord, which is the usual
+// lazy-deletion trick for a heap whose entries can be superseded.
+type leaseQueueItem struct {
+	id        LeaseID
+	expiresAt time.Time
+}
+
+type leaseQueue []leaseQueueItem
+
+func (q leaseQueue) Len() int            { return len(q) }
+func (q leaseQueue) Less(i, j int) bool  { return q[i].expiresAt.Before(q[j].expiresAt) }
+func (q leaseQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *leaseQueue) Push(x interface{}) { *q = append(*q, x.(leaseQueueItem)) }
+func (q *leaseQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// GrantLease proposes a new lease with the given TTL and, once the grant
+// has been applied on this node, returns its ID. Every replica records the
+// grant identically; only the current leader will ever schedule its
+// expiry.
+func (rn *Node) GrantLease(ctx context.Context, ttl time.Duration) (LeaseID, error) {
+	id := LeaseID(rn.reqIDGen.Next())
+	if err := rn.proposeLeaseOp(ctx, &leaseEntry{Op: leaseOpGrant, ID: id, TTL: ttl}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// KeepAliveLease renews id for another full TTL from now. If id isn't a
+// currently active lease it changes nothing and returns nil.
+func (rn *Node) KeepAliveLease(ctx context.Context, id LeaseID) error {
+	return rn.proposeLeaseOp(ctx, &leaseEntry{Op: leaseOpKeepAlive, ID: id})
+}
+
+// RevokeLease ends id immediately, without waiting for its TTL to elapse.
+func (rn *Node) RevokeLease(ctx context.Context, id LeaseID) error {
+	return rn.proposeLeaseOp(ctx, &leaseEntry{Op: leaseOpRevoke, ID: id})
+}
+
+// proposeLeaseOp proposes e and blocks until applyLeaseEntry has run for it
+// on this node, mirroring ProposeWithResponse's wait/trigger pattern. It
+// reuses rn.proposeWait keyed by the lease ID itself rather than minting a
+// second token, since e.ID already came from the same generator and is
+// guaranteed unique for the lifetime of the in-flight call.
+func (rn *Node) proposeLeaseOp(ctx context.Context, e *leaseEntry) error {
+	encoded, err := encodeLeaseEntry(e)
+	if err != nil {
+		return err
+	}
+
+	ch := rn.proposeWait.register(uint64(e.ID))
+
+	if err := rn.node.Propose(ctx, encoded); err != nil {
+		rn.proposeWait.cancel(uint64(e.ID))
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		rn.proposeWait.cancel(uint64(e.ID))
+		return ctx.Err()
+	case <-rn.stopc:
+		rn.proposeWait.cancel(uint64(e.ID))
+		return ErrReadIndexTimeout
+	}
+}
+
+// applyLeaseEntry updates the replicated lease table for a committed lease
+// entry. It runs identically on every node: only scheduleLeaseLocked's
+// leader check decides whether the local node additionally arms a timer for
+// the result.
+func (rn *Node) applyLeaseEntry(e *leaseEntry) error {
+	rn.leaseMu.Lock()
+	defer rn.leaseMu.Unlock()
+
+	switch e.Op {
+	case leaseOpGrant:
+		rec := &leaseRecord{ID: e.ID, TTL: e.TTL, ExpiresAt: time.Now().Add(e.TTL)}
+		rn.leases[e.ID] = rec
+		rn.scheduleLeaseLocked(rec)
+
+	case leaseOpKeepAlive:
+		rec, ok := rn.leases[e.ID]
+		if !ok {
+			return nil
+		}
+		rec.ExpiresAt = time.Now().Add(rec.TTL)
+		rn.scheduleLeaseLocked(rec)
+
+	case leaseOpRevoke:
+		delete(rn.leases, e.ID)
+
+	case leaseOpExpire:
+		delete(rn.leases, e.ID)
+		if expirer, ok := rn.fsm.(LeaseExpirer); ok {
+			expirer.OnLeaseExpire(e.ID)
+		}
+	}
+
+	return nil
+}
+
+// scheduleLeaseLocked queues rec's current deadline on the leader's expiry
+// heap. Callers must hold rn.leaseMu. applyLeaseEntry calls this on every
+// node regardless of leadership, so it's a no-op on a follower: onBecomeLeader
+// rebuilds the queue from scratch from rn.leases (which every node keeps up
+// to date) the moment a node actually needs to start scheduling expiries,
+// which keeps leaseQueue from growing without bound on nodes that never
+// become leader.
+func (rn *Node) scheduleLeaseLocked(rec *leaseRecord) {
+	if atomic.LoadInt32(&rn.isLeaderFlag) == 0 {
+		return
+	}
+	heap.Push(&rn.leaseQueue, leaseQueueItem{id: rec.ID, expiresAt: rec.ExpiresAt})
+	rn.resetLeaseTimerLocked()
+}
+
+// resetLeaseTimerLocked arms rn.leaseTimer for the earliest deadline left in
+// the queue, or stops it if the queue is empty. Callers must hold rn.leaseMu.
+func (rn *Node) resetLeaseTimerLocked() {
+	if rn.leaseQueue.Len() == 0 {
+		if rn.leaseTimer != nil {
+			rn.leaseTimer.Stop()
+		}
+		return
+	}
+
+	d := time.Until(rn.leaseQueue[0].expiresAt)
+	if d < 0 {
+		d = 0
+	}
+
+	if rn.leaseTimer == nil {
+		rn.leaseTimer = time.NewTimer(d)
+		return
+	}
+	rn.leaseTimer.Reset(d)
+}
+
+// onBecomeLeader rebuilds leaseQueue from the current lease table and fires
+// anything already overdue. It's the only place leaseQueue is (re)populated
+// from scratch, so a node that was a follower for however long doesn't need
+// to have tracked expiries itself: by the time it's elected, rn.leases
+// already reflects every grant/renewal/revocation committed so far.
+func (rn *Node) onBecomeLeader() {
+	rn.leaseMu.Lock()
+	rn.leaseQueue = rn.leaseQueue[:0]
+	for _, rec := range rn.leases {
+		heap.Push(&rn.leaseQueue, leaseQueueItem{id: rec.ID, expiresAt: rec.ExpiresAt})
+	}
+	rn.resetLeaseTimerLocked()
+	rn.leaseMu.Unlock()
+
+	rn.fireExpiredLeases()
+}
+
+// onLoseLeadership drops this node's expiry schedule. It'll be rebuilt from
+// scratch by onBecomeLeader if this node is elected again later; in the
+// meantime there's nothing for a follower to do with a stale queue.
+func (rn *Node) onLoseLeadership() {
+	rn.leaseMu.Lock()
+	rn.leaseQueue = rn.leaseQueue[:0]
+	if rn.leaseTimer != nil {
+		rn.leaseTimer.Stop()
+	}
+	rn.leaseMu.Unlock()
+}
+
+// leaseExpiryLoop waits for the leader's next lease deadline and, when one
+// passes, proposes a LeaseExpire entry for it. It runs on every node, but
+// fireExpiredLeases is a no-op unless this node currently believes it's the
+// leader, so expiry order stays identical everywhere: followers only ever
+// learn of an expiry through the committed LeaseExpire entry itself.
+func (rn *Node) leaseExpiryLoop() {
+	for {
+		rn.leaseMu.Lock()
+		var timerC <-chan time.Time
+		if rn.leaseTimer != nil {
+			timerC = rn.leaseTimer.C
+		}
+		rn.leaseMu.Unlock()
+
+		if timerC == nil {
+			select {
+			case <-time.After(time.Second):
+			case <-rn.stopc:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-timerC:
+			rn.fireExpiredLeases()
+		case <-rn.stopc:
+			return
+		}
+	}
+}
+
+// fireExpiredLeases pops every lease whose deadline has passed and proposes
+// a LeaseExpire entry for each. Stale heap entries left behind by a renewal
+// or revocation are discarded without proposing anything.
+func (rn *Node) fireExpiredLeases() {
+	if atomic.LoadInt32(&rn.isLeaderFlag) == 0 {
+		return
+	}
+
+	now := time.Now()
+	var expired []LeaseID
+
+	rn.leaseMu.Lock()
+	for rn.leaseQueue.Len() > 0 {
+		top := rn.leaseQueue[0]
+
+		rec, ok := rn.leases[top.id]
+		if !ok || !rec.ExpiresAt.Equal(top.expiresAt) {
+			heap.Pop(&rn.leaseQueue)
+			continue
+		}
+		if rec.ExpiresAt.After(now) {
+			break
+		}
+
+		heap.Pop(&rn.leaseQueue)
+		expired = append(expired, rec.ID)
+	}
+	rn.resetLeaseTimerLocked()
+	rn.leaseMu.Unlock()
+
+	for _, id := range expired {
+		data, err := encodeLeaseEntry(&leaseEntry{Op: leaseOpExpire, ID: id})
+		if err != nil {
+			rn.logger.Warningf("failed to encode expiry for lease %d: %s", id, err.Error())
+			continue
+		}
+		if err := rn.node.Propose(context.TODO(), data); err != nil {
+			rn.logger.Warningf("failed to propose expiry for lease %d: %s", id, err.Error())
+		}
+	}
+}
+
+// snapshotLeases captures the active lease table for inclusion in the next
+// snapshot, expressing each lease's remaining time relative to now rather
+// than as an absolute deadline.
+func (rn *Node) snapshotLeases() map[LeaseID]leaseSnapshot {
+	now := time.Now()
+
+	rn.leaseMu.Lock()
+	defer rn.leaseMu.Unlock()
+
+	out := make(map[LeaseID]leaseSnapshot, len(rn.leases))
+	for id, rec := range rn.leases {
+		out[id] = leaseSnapshot{TTL: rec.TTL, RemainingNanos: int64(rec.ExpiresAt.Sub(now))}
+	}
+	return out
+}
+
+// restoreLeases replaces the lease table with the contents of a loaded
+// snapshot, recomputing each deadline relative to this node's own clock.
+// If this node goes on to become leader, resetLeaseTimerLocked will have
+// already armed a timer for the earliest of them.
+func (rn *Node) restoreLeases(snap map[LeaseID]leaseSnapshot) {
+	now := time.Now()
+
+	rn.leaseMu.Lock()
+	defer rn.leaseMu.Unlock()
+
+	rn.leases = make(map[LeaseID]*leaseRecord, len(snap))
+	rn.leaseQueue = rn.leaseQueue[:0]
+
+	for id, s := range snap {
+		remaining := time.Duration(s.RemainingNanos)
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		rec := &leaseRecord{ID: id, TTL: s.TTL, ExpiresAt: now.Add(remaining)}
+		rn.leases[id] = rec
+		heap.Push(&rn.leaseQueue, leaseQueueItem{id: rec.ID, expiresAt: rec.ExpiresAt})
+	}
+	rn.resetLeaseTimerLocked()
+}
@@ -0,0 +1,104 @@
+package canoe
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+)
+
+func TestLeaseQueueOrdersByExpiryAscending(t *testing.T) {
+	var q leaseQueue
+	now := time.Now()
+
+	heap.Push(&q, leaseQueueItem{id: 3, expiresAt: now.Add(30 * time.Second)})
+	heap.Push(&q, leaseQueueItem{id: 1, expiresAt: now.Add(10 * time.Second)})
+	heap.Push(&q, leaseQueueItem{id: 2, expiresAt: now.Add(20 * time.Second)})
+
+	var order []LeaseID
+	for q.Len() > 0 {
+		order = append(order, heap.Pop(&q).(leaseQueueItem).id)
+	}
+
+	want := []LeaseID{1, 2, 3}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got pop order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestLeaseEntryRoundTrips(t *testing.T) {
+	encoded, err := encodeLeaseEntry(&leaseEntry{Op: leaseOpGrant, ID: 7, TTL: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	decoded, ok := decodeLeaseEntry(encoded)
+	if !ok {
+		t.Fatal("decode did not recognize an entry it encoded itself")
+	}
+	if decoded.Op != leaseOpGrant || decoded.ID != 7 || decoded.TTL != 5*time.Second {
+		t.Fatalf("got %+v, want Op=grant ID=7 TTL=5s", decoded)
+	}
+}
+
+func TestDecodeLeaseEntryRejectsNonLeaseData(t *testing.T) {
+	if _, ok := decodeLeaseEntry([]byte("not a lease entry")); ok {
+		t.Fatal("decode treated unrelated data as a lease entry")
+	}
+	if _, ok := decodeLeaseEntry(nil); ok {
+		t.Fatal("decode treated empty data as a lease entry")
+	}
+}
+
+// TestFireExpiredLeasesDiscardsStaleQueueEntries exercises the lazy-deletion
+// path directly: a lease renewed after being queued leaves a stale item
+// behind pointing at the old (now overdue) deadline, which must be
+// discarded without firing an expiry for it.
+func TestFireExpiredLeasesDiscardsStaleQueueEntries(t *testing.T) {
+	now := time.Now()
+
+	rn := &Node{
+		leases: map[LeaseID]*leaseRecord{
+			1: {ID: 1, TTL: time.Minute, ExpiresAt: now.Add(time.Hour)},
+		},
+	}
+	rn.isLeaderFlag = 1
+
+	// The stale item a renewal leaves behind: the live record's ExpiresAt
+	// has moved on, but this queue item still points at the original
+	// deadline, which is long past.
+	heap.Push(&rn.leaseQueue, leaseQueueItem{id: 1, expiresAt: now.Add(-time.Minute)})
+
+	rn.fireExpiredLeases()
+
+	if rn.leaseQueue.Len() != 0 {
+		t.Fatalf("stale queue entry was not drained, queue has %d items left", rn.leaseQueue.Len())
+	}
+	if _, ok := rn.leases[1]; !ok {
+		t.Fatal("fireExpiredLeases removed a lease whose stale queue entry it should have discarded instead")
+	}
+}
+
+// TestFireExpiredLeasesNoopOnFollower guards the invariant that only the
+// leader schedules expiries: a follower observing an overdue deadline in
+// its queue must leave the lease table untouched.
+func TestFireExpiredLeasesNoopOnFollower(t *testing.T) {
+	now := time.Now()
+
+	rn := &Node{
+		leases: map[LeaseID]*leaseRecord{
+			1: {ID: 1, TTL: time.Minute, ExpiresAt: now.Add(-time.Minute)},
+		},
+	}
+	heap.Push(&rn.leaseQueue, leaseQueueItem{id: 1, expiresAt: now.Add(-time.Minute)})
+
+	rn.fireExpiredLeases()
+
+	if rn.leaseQueue.Len() != 1 {
+		t.Fatalf("follower should leave its queue untouched, got %d items left", rn.leaseQueue.Len())
+	}
+	if _, ok := rn.leases[1]; !ok {
+		t.Fatal("follower should never remove a lease on its own; only a committed LeaseExpire entry may")
+	}
+}
@@ -0,0 +1,115 @@
+package canoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// joinRequest is the body a node asking to join the cluster posts -
+// requestSelfAddition's job, but that function isn't in this file (see the
+// doc comment on addSelfToCluster).
+type joinRequest struct {
+	ID       uint64 `json:"id"`
+	IP       string `json:"ip"`
+	RaftPort int    `json:"raft_port"`
+	APIPort  int    `json:"api_port"`
+}
+
+// learnerPromotionPollInterval is how often promoteLearnerWhenCaughtUp
+// checks whether a newly joined learner has replicated enough of the log
+// to promote to a full voting member.
+var learnerPromotionPollInterval = 200 * time.Millisecond
+
+// HandleJoinCluster is the receiving side of the add-self handshake:
+// requestSelfAddition posts a joinRequest here. It admits the new node as
+// a learner rather than a full voter, then promotes it to a full member
+// once its log has caught up, so a node added while the cluster is
+// growing can never cost it quorum before it's actually ready to
+// participate.
+//
+// Promotion depends on learnerCaughtUp, which only sees replication
+// progress while this node is the raft leader, so a learner admitted
+// through any other node stays a learner until this node becomes leader.
+//
+// serveHTTP's config service isn't in this file either, so wiring this in
+// is a matter of mounting it at whatever route requestSelfAddition
+// already posts to, e.g. mux.HandleFunc("/cluster/nodes/join", rn.HandleJoinCluster).
+func (rn *Node) HandleJoinCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req joinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("canoe: malformed join request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := rn.AddLearner(ctx, req.ID, req.IP, req.RaftPort, req.APIPort); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go rn.promoteLearnerWhenCaughtUp(req.ID)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// promoteLearnerWhenCaughtUp polls id's replication progress until it's
+// caught up to this node's log, then promotes it to a full voting member.
+// It runs as its own goroutine so HandleJoinCluster can respond to the
+// join request immediately instead of blocking on however long the new
+// node takes to replicate the existing log.
+func (rn *Node) promoteLearnerWhenCaughtUp(id uint64) {
+	ticker := time.NewTicker(learnerPromotionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rn.stopc:
+			return
+		case <-ticker.C:
+			if !rn.learnerCaughtUp(id) {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := rn.PromoteLearner(ctx, id)
+			cancel()
+			if err != nil {
+				rn.logger.Warningf("failed to promote caught-up learner %x: %s", id, err.Error())
+				continue
+			}
+			return
+		}
+	}
+}
+
+// learnerCaughtUp reports whether id's replicated log has reached this
+// node's last index, i.e. it's safe to start counting it toward quorum.
+// etcd/raft only fills Status().Progress on the leader, so on any other
+// node this reports false.
+func (rn *Node) learnerCaughtUp(id uint64) bool {
+	status := rn.node.Status()
+
+	progress, ok := status.Progress[id]
+	if !ok {
+		return false
+	}
+
+	lastIndex, err := rn.raftStorage.LastIndex()
+	if err != nil {
+		return false
+	}
+
+	return progress.Match >= lastIndex
+}
@@ -0,0 +1,86 @@
+package canoe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// fakeStatusNode implements raft.Node just enough for learnerCaughtUp's
+// tests: every other method is unused by that code path.
+type fakeStatusNode struct {
+	raft.Node
+	status raft.Status
+}
+
+func (f *fakeStatusNode) Status() raft.Status { return f.status }
+
+func TestLearnerCaughtUpComparesMatchAgainstLastIndex(t *testing.T) {
+	storage := raft.NewMemoryStorage()
+	if err := storage.Append([]raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	rn := &Node{
+		raftStorage: storage,
+		node: &fakeStatusNode{status: raft.Status{
+			Progress: map[uint64]raft.Progress{
+				7: {Match: 2},
+			},
+		}},
+	}
+
+	if !rn.learnerCaughtUp(7) {
+		t.Fatal("learner whose Match equals the last index should be caught up")
+	}
+
+	rn.node = &fakeStatusNode{status: raft.Status{
+		Progress: map[uint64]raft.Progress{
+			7: {Match: 1},
+		},
+	}}
+	if rn.learnerCaughtUp(7) {
+		t.Fatal("learner whose Match trails the last index should not be caught up")
+	}
+}
+
+func TestLearnerCaughtUpFalseForUnknownPeer(t *testing.T) {
+	rn := &Node{
+		raftStorage: raft.NewMemoryStorage(),
+		node:        &fakeStatusNode{status: raft.Status{Progress: map[uint64]raft.Progress{}}},
+	}
+
+	if rn.learnerCaughtUp(99) {
+		t.Fatal("a peer missing from Progress should never be reported caught up")
+	}
+}
+
+func TestHandleJoinClusterRejectsOtherMethods(t *testing.T) {
+	rn := &Node{}
+
+	req := httptest.NewRequest(http.MethodGet, "/cluster/nodes/join", nil)
+	rec := httptest.NewRecorder()
+
+	rn.HandleJoinCluster(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleJoinClusterRejectsMalformedBody(t *testing.T) {
+	rn := &Node{}
+
+	req := httptest.NewRequest(http.MethodPost, "/cluster/nodes/join", strings.NewReader("not json"))
+	rec := httptest.NewRecorder()
+
+	rn.HandleJoinCluster(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenk/backoff"
@@ -62,8 +63,34 @@ type Node struct {
 	ss      *snap.Snapshotter
 	wal     *wal.WAL
 
+	// engineType records which consensus backend NodeConfig asked for.
+	// See the TODO on NodeConfig.Engine: only EngineEtcdRaft is actually
+	// wired up today.
+	engineType EngineType
+
 	lastConfState *raftpb.ConfState
 
+	// applied tracks the highest raft log index that has been handed to
+	// the FSM, so linearizable reads know when it's safe to unblock.
+	applied uint64
+
+	reqIDGen     *requestIDGenerator
+	readWait     *pendingWait
+	proposeWait  *resultWait
+	pendingReads map[uint64]uint64
+	pendingMu    sync.Mutex
+
+	// isLeaderFlag is 1 while scanReady's most recent SoftState says this
+	// node is the raft leader, 0 otherwise. Only the leader schedules lease
+	// expiries; accessed with sync/atomic since GrantLease et al. are called
+	// from arbitrary caller goroutines.
+	isLeaderFlag int32
+
+	leaseMu    sync.Mutex
+	leases     map[LeaseID]*leaseRecord
+	leaseQueue leaseQueue
+	leaseTimer *time.Timer
+
 	stopc chan struct{}
 
 	logger CanoeLogger
@@ -91,9 +118,44 @@ type NodeConfig struct {
 	// if nil, then default to no snapshotting
 	SnapshotConfig *SnapshotConfig
 
+	// PreVote enables the pre-vote extension to raft's leader election,
+	// which stops a partitioned node that keeps timing out and bumping its
+	// term from disrupting the cluster's current leader once it rejoins.
+	// Strongly recommended for clusters that do rolling restarts.
+	PreVote bool
+
+	// Engine selects which consensus backend drives this Node. It
+	// defaults to EngineEtcdRaft, canoe's original github.com/coreos/etcd/raft
+	// backend, which is the only one Node can actually run today.
+	//
+	// TODO: EngineHashiRaft exists as a complete engine.ConsensusEngine
+	// implementation in engine/hashiraft, but Node still talks to
+	// etcd/raft directly rather than through that seam, so there's
+	// nothing in this package for it to plug into yet. NewNode rejects
+	// any other value instead of silently keeping the etcd-raft backend
+	// running, so this field is not a usable backend selector until
+	// Node's Start/scanReady/FSM-apply path is rewritten against
+	// engine.ConsensusEngine.
+	Engine EngineType
+
 	Logger CanoeLogger
 }
 
+// EngineType selects the consensus backend a Node uses. See the engine
+// package for the ConsensusEngine interface both backends implement.
+type EngineType string
+
+const (
+	// EngineEtcdRaft is canoe's original backend, github.com/coreos/etcd/raft.
+	EngineEtcdRaft EngineType = "etcdraft"
+
+	// EngineHashiRaft names the hashicorp/raft-backed engine.ConsensusEngine
+	// in engine/hashiraft, meant to give operators a migration path off the
+	// unmaintained etcd v2 raft imports without changing their FSM. Not
+	// yet a valid NodeConfig.Engine value: see the TODO above.
+	EngineHashiRaft EngineType = "hashiraft"
+)
+
 type CanoeLogger interface {
 	Debug(v ...interface{})
 	Debugf(format string, v ...interface{})
@@ -126,6 +188,17 @@ type SnapshotConfig struct {
 	// If the interval hasn't ticked but we've gone over a commited log threshold then snapshot
 	// Note: Use this with care. Snapshotting is a fairly expenseive process.
 	// Interval is suggested best method for triggering snapshots
+	//
+	// SnapCount, if non-zero, triggers a snapshot as soon as
+	// commitsSinceLastSnap() reaches it, independent of Interval. Use this
+	// when you'd rather bound WAL growth by the number of entries written
+	// than by wall-clock time.
+	SnapCount uint64
+
+	// KeepSnapshotCount is how many files to retain in each of the WAL,
+	// snapshot and FSM db directories; each directory is pruned by its own
+	// file count, independently of the others. If 0, nothing is ever pruned.
+	KeepSnapshotCount int
 }
 
 // Change this. We NEED to have snapshotting for some features unfortunately
@@ -161,7 +234,8 @@ func (rn *Node) UniqueID() uint64 {
 // TODO: Look into which config options we want others to specify. For now hardcoded
 // TODO: Allow user to specify KV pairs of known nodes, and bypass the http discovery
 // NOTE: Peers are used EXCLUSIVELY to round-robin to other nodes and attempt to add
-//		ourselves to an existing cluster or bootstrap node
+//
+//	ourselves to an existing cluster or bootstrap node
 func NewNode(args *NodeConfig) (*Node, error) {
 	rn, err := nonInitNode(args)
 	if err != nil {
@@ -243,6 +317,11 @@ func (rn *Node) Start() error {
 			panic(err)
 		}
 	}(rn)
+
+	rn.startSnapshotPurging()
+
+	go rn.leaseExpiryLoop()
+
 	rn.started = true
 
 	if rejoinCluster {
@@ -318,6 +397,14 @@ func (rn *Node) removeSelfFromCluster() error {
 	return backoff.RetryNotify(op, expBackoff, notify)
 }
 
+// addSelfToCluster asks an existing cluster member to admit this node.
+// requestSelfAddition drives that handshake over HTTP and isn't part of
+// this file, so this function itself has no say in learner vs. full-voter
+// status: that's decided by whichever member's HandleJoinCluster (see
+// membership_http.go) receives the request. As of that handler's
+// addition, the receiving side does admit new nodes as learners first and
+// promote them once caught up; requestSelfAddition just needs to be
+// posting to the route HandleJoinCluster is mounted on.
 func (rn *Node) addSelfToCluster() error {
 	notify := func(err error, t time.Duration) {
 		rn.logger.Warningf("Couldn't add self to cluster: %s Trying again in %v", err.Error(), t)
@@ -369,6 +456,19 @@ func nonInitNode(args *NodeConfig) (*Node, error) {
 		args.SnapshotConfig = DefaultSnapshotConfig
 	}
 
+	if args.Engine == "" {
+		args.Engine = EngineEtcdRaft
+	}
+
+	// Node still talks to github.com/coreos/etcd/raft directly rather than
+	// through engine.ConsensusEngine (see the TODO on NodeConfig.Engine), so
+	// anything other than the default backend would silently keep running
+	// etcd-raft while the caller believed they'd switched. Reject it instead
+	// of accepting a no-op.
+	if args.Engine != EngineEtcdRaft {
+		return nil, fmt.Errorf("canoe: engine %q is not yet wired up in Node; only %q is supported today", args.Engine, EngineEtcdRaft)
+	}
+
 	rn := &Node{
 		proposeC:        make(chan string),
 		raftStorage:     raft.NewMemoryStorage(),
@@ -385,7 +485,12 @@ func nonInitNode(args *NodeConfig) (*Node, error) {
 		initBackoffArgs: args.InitBackoff,
 		snapshotConfig:  args.SnapshotConfig,
 		dataDir:         args.DataDir,
+		engineType:      args.Engine,
 		logger:          args.Logger,
+		readWait:        newPendingWait(),
+		proposeWait:     newResultWait(),
+		pendingReads:    make(map[uint64]uint64),
+		leases:          make(map[LeaseID]*leaseRecord),
 	}
 
 	if rn.id == 0 {
@@ -395,6 +500,8 @@ func nonInitNode(args *NodeConfig) (*Node, error) {
 		rn.cid = 0x100
 	}
 
+	rn.reqIDGen = newRequestIDGenerator(rn.id)
+
 	//TODO: Fix these magix numbers with user-specifiable config
 	rn.raftConfig = &raft.Config{
 		ID:              rn.id,
@@ -404,6 +511,7 @@ func nonInitNode(args *NodeConfig) (*Node, error) {
 		MaxSizePerMsg:   1024 * 1024,
 		MaxInflightMsgs: 256,
 		CheckQuorum:     true,
+		PreVote:         args.PreVote,
 	}
 
 	if rn.logger != nil {
@@ -420,6 +528,16 @@ func (rn *Node) attachTransport() error {
 	ss := &stats.ServerStats{}
 	ss.Initialize()
 
+	if rn.snapDir() != "" {
+		if err := os.MkdirAll(rn.snapDir(), 0750); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(rn.dbSnapDir(), 0750); err != nil {
+			return err
+		}
+		rn.ss = snap.New(rn.snapDir())
+	}
+
 	//ID TBA on raft restoration creation
 	// due to unfortunate dependency on the restore process needing
 	rn.transport = &rafthttp.Transport{
@@ -436,7 +554,25 @@ func (rn *Node) attachTransport() error {
 }
 
 func (rn *Node) proposePeerAddition(addReq *raftpb.ConfChange, async bool) error {
-	addReq.Type = raftpb.ConfChangeAddNode
+	return rn.proposeConfChange(raftpb.ConfChangeAddNode, addReq, async)
+}
+
+// proposeAddLearner proposes a non-voting peer. It mirrors
+// proposePeerAddition exactly, save for the conf change type, so a learner
+// never counts toward quorum until it's explicitly promoted.
+func (rn *Node) proposeAddLearner(addReq *raftpb.ConfChange, async bool) error {
+	return rn.proposeConfChange(raftpb.ConfChangeAddLearnerNode, addReq, async)
+}
+
+// proposePromoteLearner proposes turning an existing learner into a full
+// voting member. It's just a ConfChangeAddNode for an already-known NodeID;
+// raft treats re-adding an existing learner as a promotion.
+func (rn *Node) proposePromoteLearner(promReq *raftpb.ConfChange, async bool) error {
+	return rn.proposeConfChange(raftpb.ConfChangeAddNode, promReq, async)
+}
+
+func (rn *Node) proposeConfChange(ccType raftpb.ConfChangeType, req *raftpb.ConfChange, async bool) error {
+	req.Type = ccType
 
 	observChan := make(chan Observation)
 	// setup listener for node addition
@@ -453,9 +589,9 @@ func (rn *Node) proposePeerAddition(addReq *raftpb.ConfChange, async bool) error
 					cc.Unmarshal(entry.Data)
 					rn.node.ApplyConfChange(cc)
 					switch cc.Type {
-					case raftpb.ConfChangeAddNode:
+					case ccType:
 						// wait until we get a matching node id
-						return addReq.NodeID == cc.NodeID
+						return req.NodeID == cc.NodeID
 					default:
 						return false
 					}
@@ -472,7 +608,7 @@ func (rn *Node) proposePeerAddition(addReq *raftpb.ConfChange, async bool) error
 		defer rn.UnregisterObserver(observer)
 	}
 
-	if err := rn.node.ProposeConfChange(context.TODO(), *addReq); err != nil {
+	if err := rn.node.ProposeConfChange(context.TODO(), *req); err != nil {
 		return err
 	}
 
@@ -488,6 +624,48 @@ func (rn *Node) proposePeerAddition(addReq *raftpb.ConfChange, async bool) error
 	}
 }
 
+// AddLearner proposes id as a non-voting member of the cluster. Learners
+// receive log entries and snapshots like any other peer, but raft won't
+// count them toward quorum until PromoteLearner is called for them. This
+// lets a new node catch up on the log before it can affect availability.
+func (rn *Node) AddLearner(ctx context.Context, id uint64, ip string, raftPort, apiPort int) error {
+	if !rn.canAlterPeer() {
+		return errors.New("cannot alter peer, node is not in a healthy state")
+	}
+
+	ctxData, err := json.Marshal(&confChangeNodeContext{
+		IP:        ip,
+		RaftPort:  raftPort,
+		APIPort:   apiPort,
+		IsLearner: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	cc := &raftpb.ConfChange{
+		NodeID:  id,
+		Context: ctxData,
+	}
+
+	return rn.proposeAddLearner(cc, false)
+}
+
+// PromoteLearner proposes turning an existing learner into a full voting
+// member. The peer keeps its existing connection info; only its membership
+// type changes, so quorum math starts counting it from this point on.
+func (rn *Node) PromoteLearner(ctx context.Context, id uint64) error {
+	if !rn.canAlterPeer() {
+		return errors.New("cannot alter peer, node is not in a healthy state")
+	}
+
+	cc := &raftpb.ConfChange{
+		NodeID: id,
+	}
+
+	return rn.proposePromoteLearner(cc, false)
+}
+
 func (rn *Node) proposePeerDeletion(delReq *raftpb.ConfChange, async bool) error {
 	delReq.Type = raftpb.ConfChangeRemoveNode
 
@@ -555,6 +733,8 @@ func (rn *Node) scanReady() error {
 	defer func(rn *Node) {
 		rn.running = false
 	}(rn)
+	defer rn.readWait.cancelAll(errors.New("node is no longer running"))
+	defer rn.proposeWait.cancelAll(errors.New("node is no longer running"))
 
 	var snapTicker *time.Ticker
 
@@ -588,7 +768,9 @@ func (rn *Node) scanReady() error {
 				rn.wal.Save(rd.HardState, rd.Entries)
 			}
 			rn.raftStorage.Append(rd.Entries)
-			rn.transport.Send(rd.Messages)
+			regularMsgs, snapMsgs := splitSnapshotMessages(rd.Messages)
+			rn.transport.Send(regularMsgs)
+			rn.sendSnapshots(snapMsgs)
 
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				if err := rn.processSnapshot(rd.Snapshot); err != nil {
@@ -596,12 +778,40 @@ func (rn *Node) scanReady() error {
 				}
 			}
 
+			if rd.SoftState != nil {
+				rn.observe(*rd.SoftState)
+
+				if rd.SoftState.RaftState == raft.StateLeader {
+					if atomic.SwapInt32(&rn.isLeaderFlag, 1) == 0 {
+						rn.onBecomeLeader()
+					}
+				} else {
+					if atomic.SwapInt32(&rn.isLeaderFlag, 0) == 1 {
+						rn.onLoseLeadership()
+					}
+				}
+
+				if rd.SoftState.Lead == raft.None {
+					// we can no longer guarantee these will ever be satisfied
+					rn.readWait.cancelAll(errors.New("lost leader while waiting for read index"))
+					rn.proposeWait.cancelAll(errors.New("lost leader while waiting for proposal to apply"))
+				}
+			}
+
+			rn.recordReadStates(rd.ReadStates)
+
 			if err := rn.publishEntries(rd.CommittedEntries); err != nil {
 				return err
 			}
 
 			rn.node.Advance()
 
+			if rn.snapshotConfig.SnapCount > 0 && rn.commitsSinceLastSnap() >= rn.snapshotConfig.SnapCount {
+				if err := rn.createSnapAndCompact(false); err != nil {
+					return err
+				}
+			}
+
 		}
 	}
 	return nil
@@ -612,20 +822,33 @@ func (rn *Node) restoreFSMFromSnapshot(raftSnap raftpb.Snapshot) error {
 		return nil
 	}
 
-	var snapStruct snapshot
-	if err := json.Unmarshal(raftSnap.Data, &snapStruct); err != nil {
+	var header snapshotMetadata
+	if err := json.Unmarshal(raftSnap.Data, &header); err != nil {
 		return err
 	}
 
-	for id, info := range snapStruct.Metadata.Peers {
+	for id, info := range header.Peers {
 		raftURL := fmt.Sprintf("http://%s:%d", info.IP, info.RaftPort)
 		rn.transport.AddPeer(types.ID(id), []string{raftURL})
 	}
+	rn.peerMap = header.Peers
 
-	if err := rn.fsm.Restore(SnapshotData(snapStruct.Data)); err != nil {
+	if err := rn.readFSMSnapshot(&header); err != nil {
 		return err
 	}
 
+	rn.restoreLeases(header.Leases)
+
+	// the FSM state just jumped out from under any in-flight readers or
+	// proposers; they can't trust the result they'd get so fail them now
+	// instead of leaving them blocked forever.
+	rn.pendingMu.Lock()
+	rn.pendingReads = make(map[uint64]uint64)
+	rn.applied = raftSnap.Metadata.Index
+	rn.pendingMu.Unlock()
+	rn.readWait.cancelAll(errors.New("read index invalidated by snapshot restore"))
+	rn.proposeWait.cancelAll(errors.New("proposal invalidated by snapshot restore"))
+
 	return nil
 }
 
@@ -646,32 +869,71 @@ func (rn *Node) processSnapshot(raftSnap raftpb.Snapshot) error {
 	return nil
 }
 
-type snapshot struct {
-	Metadata *snapshotMetadata `json:"metadata"`
-	Data     []byte            `json:"data"`
-}
-
+// snapshotMetadata is the small header embedded in raftpb.Snapshot.Data.
+// The bulk of the FSM's state lives on disk in File instead, so a node
+// catching up from a cold start never needs the whole thing in memory just
+// to apply a raft snapshot.
 type snapshotMetadata struct {
 	Peers map[uint64]confChangeNodeContext `json:"peers"`
+
+	// File is the name (not full path) of the FSM state file under
+	// <DataDir>/snap. Empty for snapshots taken before streaming support
+	// was added, in which case Data carries the legacy inline payload.
+	File string `json:"file"`
+
+	// Sha256 is the hex-encoded checksum of whichever of File/InlineData
+	// is set, verified before it's handed to the FSM so a truncated
+	// transfer is caught early.
+	Sha256 string `json:"sha256"`
+
+	// InlineData carries the FSM's entire state when the snapshot was
+	// taken with no DataDir configured, so there's nowhere on disk to
+	// stream a db file to. File and InlineData are mutually exclusive:
+	// writeFSMSnapshot only ever sets one of the two.
+	InlineData []byte `json:"inline_data,omitempty"`
+
+	// Leases is the active lease table at the time the snapshot was taken,
+	// keyed by LeaseID. Remaining TTLs are stored relative to the snapshot's
+	// own wall-clock time rather than as absolute deadlines, since a
+	// restarted node's clock has no relationship to the one that wrote the
+	// snapshot; restoreLeases recomputes deadlines against the new node's
+	// clock on load.
+	Leases map[LeaseID]leaseSnapshot `json:"leases,omitempty"`
 }
 
 func (p *snapshotMetadata) MarshalJSON() ([]byte, error) {
 	tmpStruct := &struct {
-		Peers map[string]confChangeNodeContext `json:"peers"`
+		Peers      map[string]confChangeNodeContext `json:"peers"`
+		File       string                           `json:"file"`
+		Sha256     string                           `json:"sha256"`
+		InlineData []byte                           `json:"inline_data,omitempty"`
+		Leases     map[string]leaseSnapshot         `json:"leases,omitempty"`
 	}{
-		Peers: make(map[string]confChangeNodeContext),
+		Peers:      make(map[string]confChangeNodeContext),
+		File:       p.File,
+		Sha256:     p.Sha256,
+		InlineData: p.InlineData,
+		Leases:     make(map[string]leaseSnapshot),
 	}
 
 	for key, val := range p.Peers {
 		tmpStruct.Peers[strconv.FormatUint(key, 10)] = val
 	}
 
+	for key, val := range p.Leases {
+		tmpStruct.Leases[strconv.FormatUint(uint64(key), 10)] = val
+	}
+
 	return json.Marshal(tmpStruct)
 }
 
 func (p *snapshotMetadata) UnmarshalJSON(data []byte) error {
 	tmpStruct := &struct {
-		Peers map[string]confChangeNodeContext `json:"peers"`
+		Peers      map[string]confChangeNodeContext `json:"peers"`
+		File       string                           `json:"file"`
+		Sha256     string                           `json:"sha256"`
+		InlineData []byte                           `json:"inline_data,omitempty"`
+		Leases     map[string]leaseSnapshot         `json:"leases,omitempty"`
 	}{}
 
 	if err := json.Unmarshal(data, tmpStruct); err != nil {
@@ -688,6 +950,20 @@ func (p *snapshotMetadata) UnmarshalJSON(data []byte) error {
 		p.Peers[convKey] = val
 	}
 
+	p.Leases = make(map[LeaseID]leaseSnapshot)
+
+	for key, val := range tmpStruct.Leases {
+		convKey, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return err
+		}
+		p.Leases[LeaseID(convKey)] = val
+	}
+
+	p.File = tmpStruct.File
+	p.Sha256 = tmpStruct.Sha256
+	p.InlineData = tmpStruct.InlineData
+
 	return nil
 }
 
@@ -703,19 +979,19 @@ func (rn *Node) createSnapAndCompact(force bool) error {
 		return nil
 	}
 
-	fsmData, err := rn.fsm.Snapshot()
+	term, err := rn.raftStorage.Term(index)
 	if err != nil {
 		return err
 	}
 
-	finalSnap := &snapshot{
-		Metadata: &snapshotMetadata{
-			Peers: rn.peerMap,
-		},
-		Data: []byte(fsmData),
+	header, err := rn.writeFSMSnapshot(term, index)
+	if err != nil {
+		return err
 	}
+	header.Peers = rn.peerMap
+	header.Leases = rn.snapshotLeases()
 
-	data, err := json.Marshal(finalSnap)
+	data, err := json.Marshal(header)
 	if err != nil {
 		return err
 	}
@@ -754,6 +1030,11 @@ type confChangeNodeContext struct {
 	IP       string `json:"ip"`
 	RaftPort int    `json:"raft_port"`
 	APIPort  int    `json:"api_port"`
+
+	// IsLearner marks a peer as a non-voting member added via AddLearner.
+	// Learners receive log entries and snapshots like any other peer but
+	// don't count toward quorum until PromoteLearner is called for them.
+	IsLearner bool `json:"is_learner"`
 }
 
 var ErrorRemovedFromCluster = errors.New("I have been removed from cluster")
@@ -765,11 +1046,26 @@ func (rn *Node) publishEntries(ents []raftpb.Entry) error {
 			if len(entry.Data) == 0 {
 				break
 			}
+
+			if lease, ok := decodeLeaseEntry(entry.Data); ok {
+				rn.proposeWait.trigger(uint64(lease.ID), rn.applyLeaseEntry(lease))
+				break
+			}
+
+			reqID, payload, isEnvelope := decodeProposalEnvelope(entry.Data)
+			if !isEnvelope {
+				payload = entry.Data
+			}
+
 			// Yes, this is probably a blocking call
 			// An FSM should be responsible for being efficient
 			// for high-load situations
-			if err := rn.fsm.Apply(LogData(entry.Data)); err != nil {
-				return err
+			applyErr := rn.fsm.Apply(LogData(payload))
+
+			if isEnvelope {
+				rn.proposeWait.trigger(reqID, applyErr)
+			} else if applyErr != nil {
+				return applyErr
 			}
 
 		case raftpb.EntryConfChange:
@@ -779,12 +1075,13 @@ func (rn *Node) publishEntries(ents []raftpb.Entry) error {
 			rn.lastConfState = confState
 
 			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
+			case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
 				if len(cc.Context) > 0 {
 					var ctxData confChangeNodeContext
 					if err := json.Unmarshal(cc.Context, &ctxData); err != nil {
 						return err
 					}
+					ctxData.IsLearner = cc.Type == raftpb.ConfChangeAddLearnerNode
 
 					raftURL := fmt.Sprintf("http://%s:%d", ctxData.IP, ctxData.RaftPort)
 
@@ -792,6 +1089,13 @@ func (rn *Node) publishEntries(ents []raftpb.Entry) error {
 						rn.transport.AddPeer(types.ID(cc.NodeID), []string{raftURL})
 					}
 					rn.peerMap[cc.NodeID] = ctxData
+				} else if cc.Type == raftpb.ConfChangeAddNode {
+					// promotion of an existing learner: no context was sent,
+					// just flip the flag we already have on file for it
+					if ctxData, ok := rn.peerMap[cc.NodeID]; ok {
+						ctxData.IsLearner = false
+						rn.peerMap[cc.NodeID] = ctxData
+					}
 				}
 			case raftpb.ConfChangeRemoveNode:
 				if cc.NodeID == uint64(rn.id) {
@@ -803,7 +1107,12 @@ func (rn *Node) publishEntries(ents []raftpb.Entry) error {
 
 		}
 		rn.observe(entry)
+
+		rn.pendingMu.Lock()
+		rn.applied = entry.Index
+		rn.pendingMu.Unlock()
 	}
+	rn.triggerReads()
 	return nil
 }
 
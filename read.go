@@ -0,0 +1,239 @@
+package canoe
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/raft"
+)
+
+// ErrReadIndexTimeout is returned by LinearizableRead, ProposeWithResponse
+// and the lease calls when the node stops before their answer arrives. A
+// context that is done first yields ctx.Err() instead.
+var ErrReadIndexTimeout = errors.New("canoe: timed out waiting for read index")
+
+const requestIDSuffixBits = 32
+
+// requestIDGenerator mints unique 8-byte tokens used to correlate a
+// ReadIndex request (or a Propose call expecting a response) with the
+// raft event that eventually satisfies it. It mirrors etcd's
+// idutil.Generator: a per-node prefix combined with a monotonically
+// increasing suffix guarantees tokens never collide across the cluster.
+type requestIDGenerator struct {
+	prefix uint64
+	suffix uint64 // accessed atomically
+}
+
+func newRequestIDGenerator(nodeID uint64) *requestIDGenerator {
+	prefix := nodeID<<requestIDSuffixBits ^ uint64(time.Now().UnixNano())
+	return &requestIDGenerator{prefix: prefix}
+}
+
+func (g *requestIDGenerator) Next() uint64 {
+	suffix := atomic.AddUint64(&g.suffix, 1)
+	return (g.prefix &^ ((uint64(1) << requestIDSuffixBits) - 1)) | (suffix & ((uint64(1) << requestIDSuffixBits) - 1))
+}
+
+// pendingWait correlates tokens with callers blocked waiting for a signal,
+// e.g. a linearizable read that has caught up to its ReadIndex.
+type pendingWait struct {
+	mu sync.Mutex
+	m  map[uint64]chan error
+}
+
+func newPendingWait() *pendingWait {
+	return &pendingWait{m: make(map[uint64]chan error)}
+}
+
+func (w *pendingWait) register(id uint64) chan error {
+	ch := make(chan error, 1)
+	w.mu.Lock()
+	w.m[id] = ch
+	w.mu.Unlock()
+	return ch
+}
+
+func (w *pendingWait) trigger(id uint64, err error) {
+	w.mu.Lock()
+	ch, ok := w.m[id]
+	if ok {
+		delete(w.m, id)
+	}
+	w.mu.Unlock()
+	if ok {
+		ch <- err
+	}
+}
+
+func (w *pendingWait) cancel(id uint64) {
+	w.mu.Lock()
+	delete(w.m, id)
+	w.mu.Unlock()
+}
+
+func (w *pendingWait) cancelAll(err error) {
+	w.mu.Lock()
+	pending := w.m
+	w.m = make(map[uint64]chan error)
+	w.mu.Unlock()
+	for _, ch := range pending {
+		ch <- err
+	}
+}
+
+// resultWait is the same shape as pendingWait; it's kept as a distinct type
+// so Propose-with-response waiters can't be confused with read waiters even
+// though the underlying mechanics are identical.
+type resultWait struct {
+	*pendingWait
+}
+
+func newResultWait() *resultWait {
+	return &resultWait{pendingWait: newPendingWait()}
+}
+
+// recordReadStates records the ReadState(s) etcd/raft handed back in the
+// latest Ready and attempts to satisfy any reads that are already caught up.
+func (rn *Node) recordReadStates(readStates []raft.ReadState) {
+	if len(readStates) == 0 {
+		return
+	}
+
+	rn.pendingMu.Lock()
+	for _, rs := range readStates {
+		if len(rs.RequestCtx) != 8 {
+			continue
+		}
+		token := binary.BigEndian.Uint64(rs.RequestCtx)
+		rn.pendingReads[token] = rs.Index
+	}
+	rn.pendingMu.Unlock()
+
+	rn.triggerReads()
+}
+
+// triggerReads unblocks any LinearizableRead callers whose requested read
+// index is now covered by the applied index.
+func (rn *Node) triggerReads() {
+	rn.pendingMu.Lock()
+	applied := rn.applied
+	var satisfied []uint64
+	for token, index := range rn.pendingReads {
+		if applied >= index {
+			satisfied = append(satisfied, token)
+		}
+	}
+	for _, token := range satisfied {
+		delete(rn.pendingReads, token)
+	}
+	rn.pendingMu.Unlock()
+
+	for _, token := range satisfied {
+		rn.readWait.trigger(token, nil)
+	}
+}
+
+// LinearizableRead blocks until the local FSM is guaranteed to reflect every
+// write committed before this call was made. It does this by asking raft for
+// a ReadIndex and waiting for the applied index to catch up to it, following
+// the same pattern etcd uses to serve linearizable reads without routing
+// them through the raft log.
+func (rn *Node) LinearizableRead(ctx context.Context) error {
+	token := rn.reqIDGen.Next()
+	ch := rn.readWait.register(token)
+
+	reqCtx := make([]byte, 8)
+	binary.BigEndian.PutUint64(reqCtx, token)
+
+	if err := rn.node.ReadIndex(ctx, reqCtx); err != nil {
+		rn.readWait.cancel(token)
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		rn.readWait.cancel(token)
+		return ctx.Err()
+	case <-rn.stopc:
+		rn.readWait.cancel(token)
+		return ErrReadIndexTimeout
+	}
+}
+
+// ReadAt performs a LinearizableRead and, once it's safe to do so, hands the
+// FSM to readFn so the caller can pull state out of it with the guarantee
+// that every write committed before ReadAt was called is visible.
+func (rn *Node) ReadAt(ctx context.Context, readFn func(FSM) (interface{}, error)) (interface{}, error) {
+	if err := rn.LinearizableRead(ctx); err != nil {
+		return nil, err
+	}
+	return readFn(rn.fsm)
+}
+
+// proposalEnvelopeMagic tags entries proposed via ProposeWithResponse so
+// publishEntries can tell them apart from plain Propose() payloads, which
+// are written to the log untouched for backwards compatibility.
+const proposalEnvelopeMagic byte = 0xC3
+
+type proposalEnvelope struct {
+	ID      uint64 `json:"id"`
+	Payload []byte `json:"payload"`
+}
+
+func encodeProposalEnvelope(id uint64, payload []byte) ([]byte, error) {
+	body, err := json.Marshal(&proposalEnvelope{ID: id, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{proposalEnvelopeMagic}, body...), nil
+}
+
+func decodeProposalEnvelope(data []byte) (id uint64, payload []byte, ok bool) {
+	if len(data) == 0 || data[0] != proposalEnvelopeMagic {
+		return 0, nil, false
+	}
+
+	var env proposalEnvelope
+	if err := json.Unmarshal(data[1:], &env); err != nil {
+		return 0, nil, false
+	}
+	return env.ID, env.Payload, true
+}
+
+// ProposeWithResponse behaves like Propose, but blocks until the entry has
+// been applied to the FSM and returns the error (if any) that FSM.Apply
+// produced, instead of returning as soon as the proposal is merely
+// submitted to raft.
+func (rn *Node) ProposeWithResponse(ctx context.Context, data []byte) error {
+	id := rn.reqIDGen.Next()
+	encoded, err := encodeProposalEnvelope(id, data)
+	if err != nil {
+		return err
+	}
+
+	ch := rn.proposeWait.register(id)
+
+	if err := rn.node.Propose(ctx, encoded); err != nil {
+		rn.proposeWait.cancel(id)
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		rn.proposeWait.cancel(id)
+		return ctx.Err()
+	case <-rn.stopc:
+		rn.proposeWait.cancel(id)
+		return ErrReadIndexTimeout
+	}
+}
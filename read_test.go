@@ -0,0 +1,124 @@
+package canoe
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRequestIDGeneratorIsUniqueAndMonotonic(t *testing.T) {
+	gen := newRequestIDGenerator(7)
+
+	seen := make(map[uint64]bool)
+	var prev uint64
+	for i := 0; i < 1000; i++ {
+		id := gen.Next()
+		if seen[id] {
+			t.Fatalf("duplicate id %d on iteration %d", id, i)
+		}
+		seen[id] = true
+
+		if i > 0 && id <= prev {
+			t.Fatalf("id %d did not increase past previous id %d", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestRequestIDGeneratorDifferentNodesDontCollide(t *testing.T) {
+	a := newRequestIDGenerator(1)
+	b := newRequestIDGenerator(2)
+
+	for i := 0; i < 100; i++ {
+		if a.Next() == b.Next() {
+			t.Fatal("ids from different node generators collided")
+		}
+	}
+}
+
+func TestPendingWaitTriggerDeliversToWaiter(t *testing.T) {
+	w := newPendingWait()
+	ch := w.register(42)
+
+	want := errors.New("boom")
+	w.trigger(42, want)
+
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got error %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("trigger did not deliver to the registered channel")
+	}
+}
+
+func TestPendingWaitTriggerUnknownIDIsANoop(t *testing.T) {
+	w := newPendingWait()
+	// should not panic or block
+	w.trigger(99, errors.New("nobody is listening"))
+}
+
+func TestPendingWaitCancelStopsFutureTrigger(t *testing.T) {
+	w := newPendingWait()
+	ch := w.register(1)
+	w.cancel(1)
+
+	w.trigger(1, errors.New("too late"))
+
+	select {
+	case <-ch:
+		t.Fatal("cancel did not prevent a later trigger from being delivered")
+	default:
+	}
+}
+
+func TestPendingWaitCancelAllDeliversToEveryWaiter(t *testing.T) {
+	w := newPendingWait()
+	chans := make([]chan error, 5)
+	for i := range chans {
+		chans[i] = w.register(uint64(i))
+	}
+
+	want := errors.New("shutting down")
+	w.cancelAll(want)
+
+	for i, ch := range chans {
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Fatalf("waiter %d got %v, want %v", i, got, want)
+			}
+		default:
+			t.Fatalf("waiter %d was never delivered to by cancelAll", i)
+		}
+	}
+}
+
+func TestProposalEnvelopeRoundTrips(t *testing.T) {
+	payload := []byte("hello raft")
+
+	encoded, err := encodeProposalEnvelope(123, payload)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	id, decoded, ok := decodeProposalEnvelope(encoded)
+	if !ok {
+		t.Fatal("decode did not recognize an envelope it encoded itself")
+	}
+	if id != 123 {
+		t.Fatalf("got id %d, want 123", id)
+	}
+	if string(decoded) != string(payload) {
+		t.Fatalf("got payload %q, want %q", decoded, payload)
+	}
+}
+
+func TestDecodeProposalEnvelopeRejectsPlainData(t *testing.T) {
+	if _, _, ok := decodeProposalEnvelope([]byte("just a normal proposal")); ok {
+		t.Fatal("decode treated a non-envelope payload as an envelope")
+	}
+	if _, _, ok := decodeProposalEnvelope(nil); ok {
+		t.Fatal("decode treated empty data as an envelope")
+	}
+}
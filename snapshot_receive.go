@@ -0,0 +1,110 @@
+package canoe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// decodeSnapshotMessageHeader reads the length-prefixed, protobuf-encoded
+// raftpb.Message that rafthttp's stock sender (createSnapBody in
+// github.com/coreos/etcd/rafthttp) prepends to every snapshot body: an
+// 8-byte big-endian length followed by that many bytes of marshaled
+// message. It's reimplemented here instead of imported because rafthttp's
+// own messageDecoder is unexported.
+func decodeSnapshotMessageHeader(r io.Reader) (raftpb.Message, error) {
+	var m raftpb.Message
+
+	var size uint64
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return m, err
+	}
+
+	buf := make([]byte, int(size))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return m, err
+	}
+
+	return m, m.Unmarshal(buf)
+}
+
+// handleSnapshot is the receiving side of snapshotSender. It can't reuse
+// rafthttp's stock snapshotHandler because that hands the body straight to
+// snap.Snapshotter.SaveDBFrom, which writes under snapDir() using etcd's
+// own <index>.snap.db naming - not dbSnapDir()/<file>, which is where
+// readFSMSnapshot looks. Instead this decodes the same message header the
+// stock handler would, then streams whatever's left (the raw FSM db file,
+// if writeFSMSnapshot didn't keep everything inline) straight to a temp
+// file and atomically renames it into place.
+//
+// serveRaft isn't in this file, so wiring this in is a matter of mounting
+// it where the stock snapshotHandler would otherwise go, e.g.
+// mux.Handle(rafthttp.RaftSnapshotPrefix, http.HandlerFunc(rn.handleSnapshot)).
+func (rn *Node) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := decodeSnapshotMessageHeader(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("canoe: failed to decode snapshot message: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	var header snapshotMetadata
+	if err := header.UnmarshalJSON(m.Snapshot.Data); err != nil {
+		http.Error(w, fmt.Sprintf("canoe: failed to decode snapshot header: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if header.File != "" {
+		if err := rn.saveDBSnapshotFrom(r.Body, header.File); err != nil {
+			http.Error(w, fmt.Sprintf("canoe: failed to save snapshot db file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := rn.node.Step(r.Context(), m); err != nil {
+		http.Error(w, fmt.Sprintf("canoe: failed to step snapshot message: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveDBSnapshotFrom streams r to <dbSnapDir>/fileName via a temp file and
+// atomic rename, mirroring writeFSMSnapshot's own write path so a reader
+// (readFSMSnapshot, or a later snapshotSender) never observes a
+// partially-written db file.
+func (rn *Node) saveDBSnapshotFrom(r io.Reader, fileName string) error {
+	if err := os.MkdirAll(rn.dbSnapDir(), 0750); err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(rn.dbSnapDir(), fileName+".tmp")
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(rn.dbSnapDir(), fileName))
+}
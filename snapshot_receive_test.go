@@ -0,0 +1,94 @@
+package canoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// encodeSnapshotMessageHeader mirrors rafthttp's own (unexported)
+// messageEncoder: an 8-byte big-endian length followed by that many bytes
+// of marshaled message. Used here only to build fixtures for
+// decodeSnapshotMessageHeader.
+func encodeSnapshotMessageHeader(t *testing.T, m raftpb.Message) []byte {
+	t.Helper()
+
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, uint64(len(data))); err != nil {
+		t.Fatalf("writing length prefix: %v", err)
+	}
+	buf.Write(data)
+
+	return buf.Bytes()
+}
+
+func TestDecodeSnapshotMessageHeaderRoundTrips(t *testing.T) {
+	want := raftpb.Message{
+		Type: raftpb.MsgSnap,
+		From: 1,
+		To:   2,
+		Snapshot: raftpb.Snapshot{
+			Data: []byte("a snapshot header"),
+		},
+	}
+
+	encoded := encodeSnapshotMessageHeader(t, want)
+	encoded = append(encoded, []byte("trailing db bytes")...)
+
+	r := bytes.NewReader(encoded)
+	got, err := decodeSnapshotMessageHeader(r)
+	if err != nil {
+		t.Fatalf("decodeSnapshotMessageHeader: %v", err)
+	}
+
+	if got.From != want.From || got.To != want.To || got.Type != want.Type {
+		t.Fatalf("got message %+v, want %+v", got, want)
+	}
+	if string(got.Snapshot.Data) != string(want.Snapshot.Data) {
+		t.Fatalf("got snapshot data %q, want %q", got.Snapshot.Data, want.Snapshot.Data)
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if string(rest) != "trailing db bytes" {
+		t.Fatalf("decode consumed past the message header: got remainder %q", rest)
+	}
+}
+
+func TestSaveDBSnapshotFromWritesAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canoe-snapshot-receive-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rn := &Node{dataDir: dir}
+
+	if err := rn.saveDBSnapshotFrom(bytes.NewReader([]byte("db bytes")), "db-0000000000000001-0000000000000001.snap"); err != nil {
+		t.Fatalf("saveDBSnapshotFrom: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(rn.dbSnapDir(), "db-0000000000000001-0000000000000001.snap"))
+	if err != nil {
+		t.Fatalf("reading saved file: %v", err)
+	}
+	if string(got) != "db bytes" {
+		t.Fatalf("got saved content %q, want %q", got, "db bytes")
+	}
+
+	if _, err := os.Stat(filepath.Join(rn.dbSnapDir(), "db-0000000000000001-0000000000000001.snap.tmp")); !os.IsNotExist(err) {
+		t.Fatal("temp file was left behind after a successful save")
+	}
+}
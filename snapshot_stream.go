@@ -0,0 +1,260 @@
+package canoe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+)
+
+// FSMStreamer is an optional extension to FSM for state machines whose
+// state is too large to ever hold in memory as a single byte slice. If an
+// FSM implements it, Node streams snapshots straight to and from disk
+// instead of going through Snapshot/Restore's in-memory []byte.
+type FSMStreamer interface {
+	// SnapshotTo writes the FSM's complete state to w.
+	SnapshotTo(w io.Writer) error
+
+	// RestoreFrom replaces the FSM's state with what's read from r.
+	RestoreFrom(r io.Reader) error
+}
+
+// snapshotStreamAdapter lets FSMs that only implement the original
+// Snapshot/Restore contract keep working unchanged: it buffers their state
+// in memory and satisfies FSMStreamer on their behalf. Fine for small FSMs;
+// anything large should implement FSMStreamer directly.
+type snapshotStreamAdapter struct {
+	fsm FSM
+}
+
+func (a *snapshotStreamAdapter) SnapshotTo(w io.Writer) error {
+	data, err := a.fsm.Snapshot()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(data))
+	return err
+}
+
+func (a *snapshotStreamAdapter) RestoreFrom(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return a.fsm.Restore(SnapshotData(data))
+}
+
+func (rn *Node) fsmStreamer() FSMStreamer {
+	if streamer, ok := rn.fsm.(FSMStreamer); ok {
+		return streamer
+	}
+	return &snapshotStreamAdapter{fsm: rn.fsm}
+}
+
+func (rn *Node) snapDir() string {
+	if rn.dataDir == "" {
+		return ""
+	}
+	return rn.dataDir + snapDirExtension
+}
+
+// dbSnapDir is where FSM db-*.snap files live, namespaced under a "db"
+// subdirectory of snapDir rather than alongside it. The raft engine's own
+// snapshot headers (written by rn.ss, e.g. "<term>-<index>.snap") live
+// directly under snapDir; without this split, startSnapshotPurging's
+// suffix-only fileutil.PurgeFile pass over snapDir would sort both naming
+// families together and could purge the wrong family's "oldest" files.
+func (rn *Node) dbSnapDir() string {
+	if rn.snapDir() == "" {
+		return ""
+	}
+	return filepath.Join(rn.snapDir(), "db")
+}
+
+// dbFileName zero-pads term/index the same way etcd's snap.Snapshotter
+// names its own files, so a lexicographic sort (as used by the retention
+// pruning in KeepSnapshotCount) is also a chronological one.
+func dbFileName(term, index uint64) string {
+	return fmt.Sprintf("db-%016x-%016x.snap", term, index)
+}
+
+// writeFSMSnapshot streams the FSM's state to
+// <DataDir>/snap/db/db-<term>-<index>.snap and returns the header to embed
+// in the raft snapshot: just enough to find and verify the file, never the
+// state itself. If DataDir isn't configured there's nowhere to stream to,
+// so the state is buffered in memory and carried inline in the header
+// instead; scanReady's "no persistence configured" mode (walDir() == ""
+// and a zero Interval) relies on this still working without a DataDir.
+func (rn *Node) writeFSMSnapshot(term, index uint64) (*snapshotMetadata, error) {
+	if rn.dataDir == "" {
+		var buf bytes.Buffer
+		hash := sha256.New()
+		if err := rn.fsmStreamer().SnapshotTo(io.MultiWriter(&buf, hash)); err != nil {
+			return nil, err
+		}
+
+		return &snapshotMetadata{
+			InlineData: buf.Bytes(),
+			Sha256:     hex.EncodeToString(hash.Sum(nil)),
+		}, nil
+	}
+
+	if err := os.MkdirAll(rn.dbSnapDir(), 0750); err != nil {
+		return nil, err
+	}
+
+	fileName := dbFileName(term, index)
+	tmpPath := filepath.Join(rn.dbSnapDir(), fileName+".tmp")
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if err := rn.fsmStreamer().SnapshotTo(io.MultiWriter(f, hash)); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	finalPath := filepath.Join(rn.dbSnapDir(), fileName)
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return nil, err
+	}
+
+	return &snapshotMetadata{
+		File:   fileName,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// readFSMSnapshot restores the FSM from the state described by header,
+// verifying its checksum so a truncated or corrupt transfer is caught
+// before it's handed to the FSM. header.InlineData takes precedence over
+// header.File; writeFSMSnapshot only ever sets one of the two. Inline data
+// restores whether or not a DataDir is configured. A File header restored
+// on a node that doesn't have that file fails from os.Open rather than
+// silently restoring nothing.
+func (rn *Node) readFSMSnapshot(header *snapshotMetadata) error {
+	if header.File == "" && header.InlineData == nil {
+		// nothing to restore, e.g. the very first snapshot of an FSM with
+		// no state yet
+		return nil
+	}
+
+	hash := sha256.New()
+
+	if header.InlineData != nil {
+		if err := rn.fsmStreamer().RestoreFrom(io.TeeReader(bytes.NewReader(header.InlineData), hash)); err != nil {
+			return err
+		}
+	} else {
+		path := filepath.Join(rn.dbSnapDir(), header.File)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := rn.fsmStreamer().RestoreFrom(io.TeeReader(f, hash)); err != nil {
+			return err
+		}
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != header.Sha256 {
+		return fmt.Errorf("canoe: snapshot file %s failed checksum verification", header.File)
+	}
+
+	return nil
+}
+
+// splitSnapshotMessages pulls MsgSnap messages out of a raft Ready batch so
+// they can be streamed through snapshotSender instead of Transport's
+// default send path, which would otherwise try to hold the whole snapshot
+// in memory while it's read off disk.
+func splitSnapshotMessages(msgs []raftpb.Message) (regular, snaps []raftpb.Message) {
+	for _, m := range msgs {
+		if m.Type == raftpb.MsgSnap {
+			snaps = append(snaps, m)
+			continue
+		}
+		regular = append(regular, m)
+	}
+	return regular, snaps
+}
+
+// snapshotSender streams m's snapshot to its destination, mirroring etcd's
+// own merged snap.Message transfer so the leader never has to buffer the
+// entire FSM state to send it to a slow or newly joined follower.
+//
+// rn.transport.SendSnapshot already pb-encodes the whole raftpb.Message
+// (m.Snapshot, and with it m.Snapshot.Data, our header) and prepends that
+// to whatever body it's given - see createSnapBody in
+// github.com/coreos/etcd/rafthttp. So the body handed to snap.NewMessage
+// here must be *only* the raw FSM db file; re-marshaling m.Snapshot into
+// it too would double-encode the header and corrupt the stream.
+func (rn *Node) snapshotSender(m raftpb.Message) error {
+	var header snapshotMetadata
+	if err := header.UnmarshalJSON(m.Snapshot.Data); err != nil {
+		return err
+	}
+
+	var body io.ReadCloser = ioutil.NopCloser(bytes.NewReader(nil))
+	var totalSize int64
+
+	if header.File != "" {
+		dbFile, err := os.Open(filepath.Join(rn.dbSnapDir(), header.File))
+		if err != nil {
+			return err
+		}
+
+		info, err := dbFile.Stat()
+		if err != nil {
+			dbFile.Close()
+			return err
+		}
+
+		body = dbFile
+		totalSize = info.Size()
+	}
+
+	msg := snap.NewMessage(m, body, totalSize)
+	rn.transport.SendSnapshot(*msg)
+
+	select {
+	case ok := <-msg.CloseNotify():
+		if !ok {
+			return fmt.Errorf("canoe: failed to stream snapshot to %x", m.To)
+		}
+	case <-rn.stopc:
+	}
+
+	return nil
+}
+
+// sendSnapshots is scanReady's hook for the snapshot messages raft handed
+// it this round; any regular (non-snapshot) messages in the same Ready are
+// sent through the normal transport path by the caller.
+func (rn *Node) sendSnapshots(msgs []raftpb.Message) {
+	for _, m := range msgs {
+		if err := rn.snapshotSender(m); err != nil {
+			rn.logger.Warningf("failed sending snapshot to %x: %s", m.To, err.Error())
+			rn.ReportSnapshot(m.To, raft.SnapshotFailure)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package canoe
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestDbFileNameIsZeroPaddedForLexicographicOrder(t *testing.T) {
+	names := []string{
+		dbFileName(1, 9),
+		dbFileName(1, 10),
+		dbFileName(1, 100),
+		dbFileName(2, 1),
+	}
+
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Strings(sorted)
+
+	for i := range names {
+		if sorted[i] != names[i] {
+			t.Fatalf("lexicographic sort reordered chronological names: got %v, want %v", sorted, names)
+		}
+	}
+}
+
+// fakeStreamFSM is the minimal stand-in for an FSM that implements
+// FSMStreamer directly, used to exercise writeFSMSnapshot/readFSMSnapshot
+// without depending on the rest of the FSM contract.
+type fakeStreamFSM struct {
+	state []byte
+}
+
+func (f *fakeStreamFSM) SnapshotTo(w io.Writer) error {
+	_, err := w.Write(f.state)
+	return err
+}
+
+func (f *fakeStreamFSM) RestoreFrom(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.state = data
+	return nil
+}
+
+func TestWriteAndReadFSMSnapshotRoundTrips(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canoe-snapshot-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rn := &Node{dataDir: dir, fsm: &fakeStreamFSM{state: []byte("the fsm's state")}}
+
+	header, err := rn.writeFSMSnapshot(1, 42)
+	if err != nil {
+		t.Fatalf("writeFSMSnapshot: %v", err)
+	}
+	if header.File == "" {
+		t.Fatal("writeFSMSnapshot left File empty")
+	}
+
+	restored := &fakeStreamFSM{}
+	rn.fsm = restored
+
+	if err := rn.readFSMSnapshot(header); err != nil {
+		t.Fatalf("readFSMSnapshot: %v", err)
+	}
+	if string(restored.state) != "the fsm's state" {
+		t.Fatalf("got restored state %q, want %q", restored.state, "the fsm's state")
+	}
+}
+
+// TestWriteFSMSnapshotInlinesStateWithNoDataDir guards the no-persistence
+// configuration scanReady also supports: writeFSMSnapshot must not touch
+// disk when DataDir is unset, or a node snapshotting without one would
+// error out of scanReady's loop.
+func TestWriteFSMSnapshotInlinesStateWithNoDataDir(t *testing.T) {
+	rn := &Node{fsm: &fakeStreamFSM{state: []byte("in-memory state")}}
+
+	header, err := rn.writeFSMSnapshot(1, 42)
+	if err != nil {
+		t.Fatalf("writeFSMSnapshot: %v", err)
+	}
+	if header.File != "" {
+		t.Fatalf("got non-empty File %q with no DataDir configured", header.File)
+	}
+	if len(header.InlineData) == 0 {
+		t.Fatal("writeFSMSnapshot left InlineData empty with no DataDir configured")
+	}
+
+	restored := &fakeStreamFSM{}
+	rn.fsm = restored
+
+	if err := rn.readFSMSnapshot(header); err != nil {
+		t.Fatalf("readFSMSnapshot: %v", err)
+	}
+	if string(restored.state) != "in-memory state" {
+		t.Fatalf("got restored state %q, want %q", restored.state, "in-memory state")
+	}
+}
+
+func TestReadFSMSnapshotRejectsCorruptedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canoe-snapshot-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rn := &Node{dataDir: dir, fsm: &fakeStreamFSM{state: []byte("original")}}
+
+	header, err := rn.writeFSMSnapshot(1, 1)
+	if err != nil {
+		t.Fatalf("writeFSMSnapshot: %v", err)
+	}
+
+	corruptPath := rn.dbSnapDir() + string(os.PathSeparator) + header.File
+	if err := ioutil.WriteFile(corruptPath, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("corrupting snapshot file: %v", err)
+	}
+
+	rn.fsm = &fakeStreamFSM{}
+	if err := rn.readFSMSnapshot(header); err == nil {
+		t.Fatal("readFSMSnapshot accepted a file whose checksum no longer matches")
+	}
+}
@@ -0,0 +1,66 @@
+package canoe
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestCommitsSinceLastSnapCountsEntriesPastTheLastSnapshot(t *testing.T) {
+	storage := raft.NewMemoryStorage()
+	rn := &Node{raftStorage: storage}
+
+	if got := rn.commitsSinceLastSnap(); got != 0 {
+		t.Fatalf("got %d commits on empty storage, want 0", got)
+	}
+
+	entries := []raftpb.Entry{
+		{Index: 1, Term: 1},
+		{Index: 2, Term: 1},
+		{Index: 3, Term: 1},
+	}
+	if err := storage.Append(entries); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if got := rn.commitsSinceLastSnap(); got != 3 {
+		t.Fatalf("got %d commits since last snapshot, want 3", got)
+	}
+
+	if _, err := storage.CreateSnapshot(2, nil, nil); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if err := storage.Compact(2); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	if got := rn.commitsSinceLastSnap(); got != 1 {
+		t.Fatalf("got %d commits after snapshotting through index 2, want 1", got)
+	}
+}
+
+// TestSnapCountTriggerBoundary repeats the ">=" comparison scanReady uses to
+// decide whether to trigger a snapshot, so an off-by-one in
+// commitsSinceLastSnap would fail this test instead of only showing up as
+// overly-eager or overly-lazy snapshotting in prod. The comparison here is
+// the test's own copy; a change to scanReady's comparison alone is not
+// caught by it.
+func TestSnapCountTriggerBoundary(t *testing.T) {
+	storage := raft.NewMemoryStorage()
+	rn := &Node{raftStorage: storage, snapshotConfig: &SnapshotConfig{SnapCount: 3}}
+
+	if err := storage.Append([]raftpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if rn.commitsSinceLastSnap() >= rn.snapshotConfig.SnapCount {
+		t.Fatal("2 commits should not yet reach a SnapCount of 3")
+	}
+
+	if err := storage.Append([]raftpb.Entry{{Index: 3, Term: 1}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if rn.commitsSinceLastSnap() < rn.snapshotConfig.SnapCount {
+		t.Fatal("3 commits should reach a SnapCount of 3")
+	}
+}